@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/linkerd/linkerd2/pkg/inject"
+	"github.com/linkerd/linkerd2/pkg/k8s"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+// injectOptions holds the flags accepted by `linkerd inject`.
+type injectOptions struct {
+	output      string
+	parallelism int
+	insecure    bool
+	digest      string
+}
+
+func newInjectOptions() *injectOptions {
+	return &injectOptions{
+		output:      "yaml",
+		parallelism: 1,
+	}
+}
+
+func newCmdInject() *cobra.Command {
+	options := newInjectOptions()
+
+	cmd := &cobra.Command{
+		Use:   "inject [flags] CONFIG-FILE",
+		Short: "Add the Linkerd proxy to a Kubernetes config",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in, err := read(args[0], readOptions{insecure: options.insecure, digest: options.digest})
+			if err != nil {
+				return err
+			}
+
+			os.Exit(transformInput(in, os.Stderr, os.Stdout, resourceTransformerInject{}, options.output, options.parallelism))
+			return nil
+		},
+	}
+
+	cmd.PersistentFlags().StringVarP(&options.output, "output", "o", options.output, "Output format: yaml, json, ndjson, jsonpatch, or diff")
+	cmd.PersistentFlags().IntVar(&options.parallelism, "parallelism", options.parallelism, "Number of documents to transform concurrently (<1 uses the number of CPUs)")
+	cmd.PersistentFlags().BoolVar(&options.insecure, "insecure", false, "Allow plain HTTP when CONFIG-FILE is a URL")
+	cmd.PersistentFlags().StringVar(&options.digest, "digest", "", "Verify a CONFIG-FILE URL against a sha256:<hex> digest (the manifest digest for oci://); local files and stdin are not checked")
+
+	return cmd
+}
+
+// resourceTransformerInject implements resourceTransformer for `linkerd
+// inject`: it sets the proxy-injection annotation on the pod template the
+// manifest describes.
+type resourceTransformerInject struct{}
+
+func (resourceTransformerInject) transform(bytes []byte) ([]byte, []byte, []inject.Report, error) {
+	return setProxyInjectAnnotation(bytes, k8s.ProxyInjectEnabled)
+}
+
+func (resourceTransformerInject) generateReport(reports []inject.Report, out io.Writer) {
+	fmt.Fprintf(out, "\nSummary: %d YAML document(s) injected\n", len(reports))
+}
+
+// setProxyInjectAnnotation sets the linkerd.io/inject annotation to value on
+// the Pod, or the pod template of a higher-level workload, that raw
+// describes. It returns both the re-serialized original and the updated
+// result so callers can compare them for "diff"/"jsonpatch".
+func setProxyInjectAnnotation(raw []byte, value string) ([]byte, []byte, []inject.Report, error) {
+	obj, err := decodeManifest(raw)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	original, err := yaml.Marshal(obj)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	podTemplateAnnotations(obj)[k8s.ProxyInjectAnnotation] = value
+
+	result, err := yaml.Marshal(obj)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return original, result, []inject.Report{{}}, nil
+}
+
+// decodeManifest decodes raw into a generic map, so an annotation edit
+// round-trips through yaml.Marshal without disturbing unrelated fields.
+func decodeManifest(raw []byte) (map[string]interface{}, error) {
+	var obj map[string]interface{}
+	if err := yaml.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// podTemplateAnnotations returns the annotations map the proxy-injection
+// annotation belongs on: a bare Pod's own metadata, or the pod template
+// metadata of a higher-level workload (Deployment, StatefulSet, etc.),
+// creating any missing intermediate maps.
+func podTemplateAnnotations(obj map[string]interface{}) map[string]interface{} {
+	meta := obj
+	if kind, _ := obj["kind"].(string); kind != "Pod" {
+		meta = nestedMap(obj, "spec", "template")
+	}
+	return nestedMap(meta, "metadata", "annotations")
+}
+
+// nestedMap returns the map at path within obj, creating any missing
+// intermediate maps.
+func nestedMap(obj map[string]interface{}, path ...string) map[string]interface{} {
+	cur := obj
+	for _, key := range path {
+		next, ok := cur[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			cur[key] = next
+		}
+		cur = next
+	}
+	return cur
+}
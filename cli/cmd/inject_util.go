@@ -1,8 +1,14 @@
 package cmd
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,29 +16,49 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
-	"unicode"
+	"sync"
 
+	libjsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/linkerd/linkerd2/pkg/inject"
-	corev1 "k8s.io/api/core/v1"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pmezard/go-difflib/difflib"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
 	yamlDecoder "k8s.io/apimachinery/pkg/util/yaml"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry/remote"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
 	"sigs.k8s.io/yaml"
 )
 
+// kustomizationFileNames mark a directory as a Kustomize overlay root,
+// mirroring the set `kustomize build` recognizes.
+var kustomizationFileNames = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
 type resourceTransformer interface {
-	transform([]byte) ([]byte, []inject.Report, error)
+	// transform returns the injected/uninjected form of the resource
+	// described by bytes. original is bytes re-serialized in the same
+	// normalized form as result, so that callers comparing the two (for
+	// the "diff" and "jsonpatch" output formats) aren't tripped up by
+	// incidental formatting differences between the input and the output.
+	transform(bytes []byte) (original []byte, result []byte, reports []inject.Report, err error)
 	generateReport([]inject.Report, io.Writer)
 }
 
 // Returns the integer representation of os.Exit code; 0 on success and 1 on failure.
-func transformInput(inputs []io.Reader, errWriter, outWriter io.Writer, rt resourceTransformer, format string) int {
+// parallelism bounds how many documents are transformed concurrently per
+// input (<1 means runtime.NumCPU()); parallelism=1 matches the old
+// sequential output byte-for-byte.
+func transformInput(inputs []io.Reader, errWriter, outWriter io.Writer, rt resourceTransformer, format string, parallelism int) int {
 	postInjectBuf := &bytes.Buffer{}
 	reportBuf := &bytes.Buffer{}
 
 	for _, input := range inputs {
-		errs := processYAML(input, postInjectBuf, reportBuf, rt, format)
+		errs := processYAML(input, postInjectBuf, reportBuf, rt, format, parallelism)
 		if len(errs) > 0 {
 			fmt.Fprintf(errWriter, "Error transforming resources:\n%v", concatErrors(errs, "\n"))
 			return 1
@@ -51,153 +77,756 @@ func transformInput(inputs []io.Reader, errWriter, outWriter io.Writer, rt resou
 	return 0
 }
 
-// processYAML takes an input stream of YAML, outputting injected/uninjected YAML to out.
-func processYAML(in io.Reader, out io.Writer, report io.Writer, rt resourceTransformer, format string) []error {
-	var reader yamlDecoder.Reader
-	buffer, _, isJSON := guessJSONStream(in, 4096)
-	if isJSON {
-		// We assume that json documents will be separated by newlines.
-		reader = &lineReader{reader: buffer}
+// documentJob is a single document handed to the transform worker pool,
+// tagged with its position in the input stream.
+type documentJob struct {
+	index int
+	doc   []byte
+}
 
-	} else {
-		reader = yamlDecoder.NewYAMLReader(buffer)
+// documentResult is a documentJob's outcome, keyed by index so the
+// collector can restore input order regardless of completion order.
+type documentResult struct {
+	index   int
+	output  []byte
+	reports []inject.Report
+	err     error
+}
+
+// processYAML takes an input stream of YAML and/or JSON (the two may be
+// interleaved, since each "---"-delimited document is sniffed
+// independently), outputting injected/uninjected YAML to out. Documents are
+// decoded sequentially but handed off to a bounded pool of parallelism
+// workers that call rt.transform concurrently; a collector goroutine
+// reassembles results by index to keep output and reports in input order.
+func processYAML(in io.Reader, out io.Writer, report io.Writer, rt resourceTransformer, format string, parallelism int) []error {
+	splitter := newDocumentSplitter(in)
+
+	if parallelism < 1 {
+		parallelism = runtime.NumCPU()
 	}
 
-	reports := []inject.Report{}
+	jobs := make(chan documentJob)
+	results := make(chan documentResult)
+
+	var workers sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				output, irs, err := transformDocument(job.doc, rt, format)
+				results <- documentResult{index: job.index, output: output, reports: irs, err: err}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var readErr error
+	go func() {
+		defer close(jobs)
+		for i := 0; ; i++ {
+			doc, err := splitter.next()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					readErr = err
+				}
+				return
+			}
+			jobs <- documentJob{index: i, doc: doc}
+		}
+	}()
 
 	errs := []error{}
-
-	// Iterate over all YAML objects in the input
-	for {
-		// Read a single YAML object
-		bytes, err := reader.Read()
-		if err != nil {
-			if errors.Is(err, io.EOF) {
+	reportsByIndex := map[int][]inject.Report{}
+	pending := map[int]documentResult{}
+	next := 0
+
+	for res := range results {
+		pending[res.index] = res
+		for {
+			r, ok := pending[next]
+			if !ok {
 				break
 			}
-			return []error{err}
+			delete(pending, next)
+
+			if r.err != nil {
+				errs = append(errs, r.err)
+			}
+			reportsByIndex[r.index] = r.reports
+			if len(errs) == 0 {
+				out.Write(r.output)
+			}
+			next++
 		}
+	}
 
-		var result []byte
-		var irs []inject.Report
+	// A decode error aborts the whole stream, the same as the original
+	// sequential reader.Read() error path: no report is generated, and any
+	// errors collected from documents decoded before the failure are
+	// discarded in favor of the fatal one.
+	if readErr != nil {
+		return []error{readErr}
+	}
+
+	reports := []inject.Report{}
+	for i := 0; i < next; i++ {
+		reports = append(reports, reportsByIndex[i]...)
+	}
+
+	rt.generateReport(reports, report)
 
-		isList, err := kindIsList(bytes)
+	return errs
+}
+
+// documentSplitter splits a stream into individual documents, sniffing each
+// "---"-delimited block independently so JSON and YAML documents can freely
+// interleave in the same input: a block is decoded as one-or-more
+// newline-delimited JSON values if it starts with '{' or '[', and as a
+// single YAML document otherwise.
+type documentSplitter struct {
+	blocks  *yamlDecoder.YAMLReader
+	pending [][]byte
+}
+
+func newDocumentSplitter(in io.Reader) *documentSplitter {
+	return &documentSplitter{blocks: yamlDecoder.NewYAMLReader(bufio.NewReader(in))}
+}
+
+func (s *documentSplitter) next() ([]byte, error) {
+	for len(s.pending) == 0 {
+		block, err := s.blocks.Read()
 		if err != nil {
-			return []error{err}
-		}
-		if isList {
-			result, irs, err = processList(bytes, rt)
-		} else {
-			result, irs, err = rt.transform(bytes)
+			return nil, err
 		}
-		if err != nil {
-			errs = append(errs, err)
+
+		trimmed := bytes.TrimLeft(block, " \t\r\n")
+		if len(trimmed) == 0 {
+			continue
 		}
-		reports = append(reports, irs...)
 
-		// If the format is set to json, we need to convert the yaml to json
-		if format == "json" {
-			result, err = yaml.YAMLToJSON(result)
+		if trimmed[0] == '{' || trimmed[0] == '[' {
+			docs, err := splitJSONDocuments(trimmed)
 			if err != nil {
-				errs = append(errs, err)
+				return nil, err
+			}
+			s.pending = docs
+			continue
+		}
+
+		s.pending = [][]byte{block}
+	}
+
+	doc := s.pending[0]
+	s.pending = s.pending[1:]
+	return doc, nil
+}
+
+// splitJSONDocuments decodes block as one or more whitespace-separated JSON
+// values, so newline-delimited JSON documents inside a single "---" block
+// are returned as separate documents.
+func splitJSONDocuments(block []byte) ([][]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(block))
+
+	docs := [][]byte{}
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return docs, nil
 			}
-		} else if format == "yaml" {
-			// result is already in yaml format: noop.
+			return nil, err
+		}
+		docs = append(docs, append([]byte(nil), raw...))
+	}
+}
+
+// transformDocument runs a single document through kindIsList/processList or
+// rt.transform and encodes it per format, returning output bytes (including
+// the format's separator) ready to write verbatim. Safe to call
+// concurrently.
+func transformDocument(doc []byte, rt resourceTransformer, format string) ([]byte, []inject.Report, error) {
+	var original, result []byte
+	var irs []inject.Report
+
+	isList, err := kindIsList(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isList {
+		original, result, irs, err = processList(doc, rt)
+	} else {
+		original, result, irs, err = rt.transform(doc)
+	}
+	if err != nil {
+		return nil, irs, err
+	}
+
+	var sep []byte
+	switch format {
+	case "json":
+		result, err = yaml.YAMLToJSON(result)
+		sep = []byte("\n")
+	case "yaml":
+		// result is already in yaml format: noop.
+		sep = []byte("---\n")
+	case "ndjson":
+		// Like "json", but a List is flattened into one compact JSON object
+		// per item rather than kept as a single List value, so a stream of
+		// documents is always safe to pipe into line-oriented tools like
+		// `jq -c` one object at a time.
+		if isList {
+			result, err = ndjsonList(result)
 		} else {
-			errs = append(errs, fmt.Errorf("unsupported format %s", format))
+			result, err = yaml.YAMLToJSON(result)
 		}
+		sep = []byte("\n")
+	case "jsonpatch":
+		result, err = jsonPatch(original, result)
+		sep = []byte("\n")
+	case "diff":
+		result, err = unifiedDiff(original, result)
+		sep = []byte("\n")
+	default:
+		err = fmt.Errorf("unsupported format %s", format)
+	}
+	if err != nil {
+		return nil, irs, err
+	}
+
+	return append(result, sep...), irs, nil
+}
+
+// jsonPatch computes an RFC 6902 JSON Patch document describing how to get
+// from original to result, via a JSON merge patch flattened into ops.
+func jsonPatch(original, result []byte) ([]byte, error) {
+	originalJSON, err := yaml.YAMLToJSON(original)
+	if err != nil {
+		return nil, err
+	}
+	resultJSON, err := yaml.YAMLToJSON(result)
+	if err != nil {
+		return nil, err
+	}
+
+	mergePatch, err := libjsonpatch.CreateMergePatch(originalJSON, resultJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergePatchToJSONPatch(originalJSON, mergePatch)
+}
 
-		if len(errs) == 0 {
-			out.Write(result)
-			if format == "yaml" {
-				out.Write([]byte("---\n"))
+// mergePatchToJSONPatch flattens a JSON merge patch, taken against the
+// original document, into an RFC 6902 JSON Patch operation list: explicit
+// nulls become "remove", a member absent from original becomes an "add" of
+// its whole value, and any other leaf a "replace", each addressed by its
+// flattened pointer path.
+func mergePatchToJSONPatch(original, mergePatch []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(mergePatch, &doc); err != nil {
+		return nil, err
+	}
+	var base map[string]interface{}
+	if err := json.Unmarshal(original, &base); err != nil {
+		return nil, err
+	}
+
+	type operation struct {
+		Op    string      `json:"op"`
+		Path  string      `json:"path"`
+		Value interface{} `json:"value,omitempty"`
+	}
+	ops := []operation{}
+
+	var walk func(prefix string, node, orig map[string]interface{})
+	walk = func(prefix string, node, orig map[string]interface{}) {
+		for key, value := range node {
+			path := prefix + "/" + jsonPointerEscape(key)
+			if value == nil {
+				ops = append(ops, operation{Op: "remove", Path: path})
+				continue
+			}
+			origValue, exists := orig[key]
+			if !exists {
+				ops = append(ops, operation{Op: "add", Path: path, Value: value})
+				continue
 			}
-			if format == "json" {
-				out.Write([]byte("\n"))
+			nested, ok := value.(map[string]interface{})
+			origNested, origOK := origValue.(map[string]interface{})
+			if ok && origOK {
+				walk(path, nested, origNested)
+				continue
 			}
+			ops = append(ops, operation{Op: "replace", Path: path, Value: value})
 		}
 	}
+	walk("", doc, base)
 
-	rt.generateReport(reports, report)
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Path < ops[j].Path })
 
-	return errs
+	return json.Marshal(ops)
+}
+
+// jsonPointerEscape escapes a single JSON Pointer (RFC 6901) token.
+func jsonPointerEscape(token string) string {
+	token = strings.ReplaceAll(token, "~", "~0")
+	return strings.ReplaceAll(token, "/", "~1")
+}
+
+// ndjsonList flattens a YAML-marshaled List's items into one compact JSON
+// object per line.
+func ndjsonList(yamlBytes []byte) ([]byte, error) {
+	var list genericList
+	if err := yaml.Unmarshal(yamlBytes, &list); err != nil {
+		return nil, err
+	}
+
+	lines := make([][]byte, len(list.Items))
+	for i, item := range list.Items {
+		lines[i] = item.Raw
+	}
+	return bytes.Join(lines, []byte("\n")), nil
 }
 
+// unifiedDiff renders a unified textual diff between the original and
+// injected/uninjected YAML, for use with `-o diff`.
+func unifiedDiff(original, result []byte) ([]byte, error) {
+	diff := difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(original)),
+		B:        difflib.SplitLines(string(result)),
+		FromFile: "original",
+		ToFile:   "injected",
+		Context:  3,
+	}
+	text, err := difflib.GetUnifiedDiffString(diff)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(text), nil
+}
+
+// kindIsList reports whether bytes holds any list kind, not just the core
+// `List`: `PodList`, `ServiceList`, etc. also end in "List" and carry an
+// `items` field; checking both avoids misfiring on a kind that merely ends
+// in "List".
 func kindIsList(bytes []byte) (bool, error) {
 	var meta metav1.TypeMeta
 	if err := yaml.Unmarshal(bytes, &meta); err != nil {
 		return false, err
 	}
-	return meta.Kind == "List", nil
+	if !strings.HasSuffix(meta.Kind, "List") {
+		return false, nil
+	}
+
+	var probe struct {
+		Items json.RawMessage `json:"items"`
+	}
+	if err := yaml.Unmarshal(bytes, &probe); err != nil {
+		return false, err
+	}
+	return probe.Items != nil, nil
+}
+
+// genericList mirrors the shape shared by corev1.List and every typed
+// `*List` kind closely enough to round-trip their items as raw JSON.
+type genericList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []k8sruntime.RawExtension `json:"items"`
 }
 
-func processList(bytes []byte, rt resourceTransformer) ([]byte, []inject.Report, error) {
-	var sourceList corev1.List
+// processList unwraps a list kind and transforms each of its items,
+// recursing when an item is itself a list. It returns both the transformed
+// list and the original list re-serialized the same way, so the two remain
+// comparable for "diff"/"jsonpatch" without incidental formatting noise.
+func processList(bytes []byte, rt resourceTransformer) ([]byte, []byte, []inject.Report, error) {
+	var sourceList genericList
 	if err := yaml.Unmarshal(bytes, &sourceList); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
+	originalList := sourceList
 
 	reports := []inject.Report{}
-	items := []runtime.RawExtension{}
+	originalItems := make([]k8sruntime.RawExtension, len(sourceList.Items))
+	items := make([]k8sruntime.RawExtension, len(sourceList.Items))
+
+	for i, item := range sourceList.Items {
+		isList, err := kindIsList(item.Raw)
+		if err != nil {
+			return nil, nil, nil, err
+		}
 
-	for _, item := range sourceList.Items {
-		result, irs, err := rt.transform(item.Raw)
+		var original, result []byte
+		var irs []inject.Report
+		if isList {
+			original, result, irs, err = processList(item.Raw, rt)
+		} else {
+			original, result, irs, err = rt.transform(item.Raw)
+		}
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 
 		// At this point, we have yaml. The kubernetes internal representation is
 		// json. Because we're building a list from RawExtensions, the yaml needs
 		// to be converted to json.
+		originalJSON, err := yaml.YAMLToJSON(original)
+		if err != nil {
+			return nil, nil, nil, err
+		}
 		injected, err := yaml.YAMLToJSON(result)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 
-		items = append(items, runtime.RawExtension{Raw: injected})
+		originalItems[i] = k8sruntime.RawExtension{Raw: originalJSON}
+		items[i] = k8sruntime.RawExtension{Raw: injected}
 		reports = append(reports, irs...)
 	}
 
+	originalList.Items = originalItems
+	originalBytes, err := yaml.Marshal(originalList)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	sourceList.Items = items
 	result, err := yaml.Marshal(sourceList)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
-	return result, reports, nil
+	return originalBytes, result, reports, nil
+}
+
+// readOptions bundles the remote-fetch flags read() accepts: whether to
+// allow plaintext HTTP (`--insecure`) and a digest to verify against
+// (`--digest`).
+type readOptions struct {
+	insecure bool
+	digest   string
 }
 
 // Read all the resource files found in path into a slice of readers.
-// path can be either a file, directory or stdin.
-func read(path string) ([]io.Reader, error) {
+// path can be either a file, directory, stdin, an https:// (or, with
+// opts.insecure, http://) URL, or an oci:// artifact reference.
+func read(path string, opts readOptions) ([]io.Reader, error) {
 	if path == "-" {
 		return []io.Reader{os.Stdin}, nil
 	}
 
-	if url, ok := toURL(path); ok {
-		if strings.ToLower(url.Scheme) != "https" {
-			return nil, fmt.Errorf("only HTTPS URLs are allowed")
+	if u, ok := toURL(path); ok {
+		switch strings.ToLower(u.Scheme) {
+		case "https":
+			return readHTTP(u, opts)
+		case "http":
+			if !opts.insecure {
+				return nil, fmt.Errorf("only HTTPS URLs are allowed; pass --insecure to allow plain HTTP")
+			}
+			return readHTTP(u, opts)
+		case "oci":
+			return readOCI(u, opts)
+		default:
+			return nil, fmt.Errorf("unsupported URL scheme %q: only https, http (with --insecure), and oci are allowed", u.Scheme)
+		}
+	}
+
+	if isKustomizeRoot(path) {
+		return readKustomize(path)
+	}
+
+	if isChartArchive(path) {
+		return readChartArchive(path)
+	}
+
+	if isChartDir(path) {
+		return readChartDir(path)
+	}
+
+	return walk(path)
+}
+
+// readHTTP fetches an https:// (or, with opts.insecure, http://) URL and
+// verifies the response body against opts.digest if set.
+func readHTTP(u *url.URL, opts readOptions) ([]io.Reader, error) {
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to read URL %q, server reported %s, status code=%d", u, resp.Status, resp.StatusCode)
+	}
+
+	// Save to a buffer, so that response can be closed here
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+
+	if err := verifyDigest(buf.Bytes(), opts.digest); err != nil {
+		return nil, err
+	}
+
+	return []io.Reader{buf}, nil
+}
+
+// ociManifestMediaTypes are the layer media types readOCI accepts as
+// carrying Kubernetes manifests.
+var ociManifestMediaTypes = map[string]bool{
+	"application/vnd.cncf.kubernetes.manifests.v1+yaml": true,
+	"application/yaml":   true,
+	"application/x-yaml": true,
+}
+
+// readOCI pulls the OCI artifact referenced by an oci://registry/repo:tag
+// URL using ORAS pull semantics, streaming every layer whose media type is
+// a known Kubernetes-manifests type. opts.digest, if set, is checked
+// against the manifest descriptor (a multi-file artifact's layers
+// legitimately have distinct digests of their own).
+func readOCI(u *url.URL, opts readOptions) ([]io.Reader, error) {
+	ref := u.Host + u.Path
+
+	repo, err := remote.NewRepository(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCI reference %q: %w", ref, err)
+	}
+	repo.PlainHTTP = opts.insecure
+
+	ctx := context.Background()
+	desc, rc, err := repo.FetchReference(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch OCI artifact %q: %w", ref, err)
+	}
+	defer rc.Close()
+
+	if opts.digest != "" && desc.Digest.String() != opts.digest {
+		return nil, fmt.Errorf("digest mismatch: expected %s, got %s", opts.digest, desc.Digest.String())
+	}
+
+	manifestBytes, err := content.ReadAll(rc, desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCI manifest %q: %w", ref, err)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse OCI manifest %q: %w", ref, err)
+	}
+
+	var readers []io.Reader
+	for _, layer := range manifest.Layers {
+		if !ociManifestMediaTypes[layer.MediaType] {
+			continue
 		}
-		resp, err := http.Get(url.String())
+
+		layerRC, err := repo.Fetch(ctx, layer)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to fetch OCI layer %s: %w", layer.Digest, err)
+		}
+		data, err := content.ReadAll(layerRC, layer)
+		layerRC.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OCI layer %s: %w", layer.Digest, err)
+		}
+
+		readers = append(readers, bytes.NewReader(data))
+	}
+
+	if len(readers) == 0 {
+		return nil, fmt.Errorf("no Kubernetes manifest layers found in OCI artifact %q", ref)
+	}
+
+	return readers, nil
+}
+
+// verifyDigest checks data against a "sha256:<hex>" digest. A blank digest
+// is a no-op.
+func verifyDigest(data []byte, digest string) error {
+	if digest == "" {
+		return nil
+	}
+
+	const prefix = "sha256:"
+	if !strings.HasPrefix(digest, prefix) {
+		return fmt.Errorf("unsupported digest algorithm %q: only sha256 is supported", digest)
+	}
+
+	sum := sha256.Sum256(data)
+	actual := prefix + hex.EncodeToString(sum[:])
+	if actual != digest {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", digest, actual)
+	}
+	return nil
+}
+
+// isChartArchive returns true if path looks like a Helm chart archive.
+func isChartArchive(path string) bool {
+	return strings.HasSuffix(path, ".tgz") || strings.HasSuffix(path, ".tar.gz")
+}
+
+// isChartDir returns true if path has both a templates/ subdirectory and a
+// Chart.yaml, so an ordinary manifests directory with an unrelated
+// templates/ folder isn't mistaken for a chart.
+func isChartDir(path string) bool {
+	stat, err := os.Stat(path)
+	if err != nil || !stat.IsDir() {
+		return false
+	}
+
+	templates, err := os.Stat(filepath.Join(path, "templates"))
+	if err != nil || !templates.IsDir() {
+		return false
+	}
+
+	_, err = os.Stat(filepath.Join(path, "Chart.yaml"))
+	return err == nil
+}
+
+// isChartTemplate reports whether name is a template that should be fed
+// through the transformer: under templates/, a YAML extension, not NOTES.txt.
+func isChartTemplate(name string) bool {
+	if filepath.Base(name) == "NOTES.txt" {
+		return false
+	}
+	if !strings.Contains(filepath.ToSlash(name), "/templates/") && !strings.HasPrefix(filepath.ToSlash(name), "templates/") {
+		return false
+	}
+	ext := filepath.Ext(name)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// readChartArchive streams every templates/*.yaml file out of a Helm chart
+// .tgz/.tar.gz archive, in deterministic order, skipping NOTES.txt and
+// documents left empty by conditional templates.
+func readChartArchive(path string) ([]io.Reader, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chart archive %q: %w", path, err)
+	}
+	defer gzr.Close()
+
+	templates := map[string][]byte{}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chart archive %q: %w", path, err)
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("unable to read URL %q, server reported %s, status code=%d", path, resp.Status, resp.StatusCode)
+		if hdr.Typeflag != tar.TypeReg || !isChartTemplate(hdr.Name) {
+			continue
 		}
 
-		// Save to a buffer, so that response can be closed here
-		buf := new(bytes.Buffer)
-		_, err = buf.ReadFrom(resp.Body)
+		data, err := io.ReadAll(tr)
 		if err != nil {
 			return nil, err
 		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
 
-		return []io.Reader{buf}, nil
+		templates[hdr.Name] = data
 	}
 
-	return walk(path)
+	return chartReaders(templates), nil
+}
+
+// readChartDir streams every templates/*.yaml file out of an already
+// rendered (or un-rendered) chart directory, in the same deterministic
+// order and with the same skip rules as readChartArchive.
+func readChartDir(path string) ([]io.Reader, error) {
+	templates := map[string][]byte{}
+	werr := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isChartTemplate(rel) {
+			return nil
+		}
+
+		data, err := os.ReadFile(filepath.Clean(p))
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			templates[rel] = data
+		}
+		return nil
+	})
+	if werr != nil {
+		return nil, werr
+	}
+
+	return chartReaders(templates), nil
+}
+
+// chartReaders sorts a template name->contents map by name for
+// deterministic output and wraps each entry in an io.Reader.
+func chartReaders(templates map[string][]byte) []io.Reader {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	readers := make([]io.Reader, len(names))
+	for i, name := range names {
+		readers[i] = bytes.NewReader(templates[name])
+	}
+	return readers
+}
+
+// isKustomizeRoot returns true if path is a directory containing a
+// kustomization file, i.e. it is the root of a Kustomize overlay.
+func isKustomizeRoot(path string) bool {
+	stat, err := os.Stat(path)
+	if err != nil || !stat.IsDir() {
+		return false
+	}
+
+	for _, name := range kustomizationFileNames {
+		if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readKustomize renders the Kustomize overlay rooted at path (resolving
+// bases and patches via krusty) into a single YAML document stream.
+func readKustomize(path string) ([]io.Reader, error) {
+	k := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+
+	resMap, err := k.Run(filesys.MakeFsOnDisk(), path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build kustomize overlay %q: %w", path, err)
+	}
+
+	rendered, err := resMap.AsYaml()
+	if err != nil {
+		return nil, fmt.Errorf("failed to render kustomize overlay %q: %w", path, err)
+	}
+
+	return []io.Reader{bytes.NewReader(rendered)}, nil
 }
 
 // checks if the given string is a valid URL
@@ -265,53 +894,3 @@ func concatErrors(errs []error, delimiter string) error {
 	}
 	return errors.New(message)
 }
-
-// We copy lineReader, guessJSONStream, hasJSONPrefix, jsonPrefix, and hasPrefix
-// from https://github.com/kubernetes/apimachinery/blob/1da46c3f5a5b4a0cc756cb6050df0cf6f06b64c2/pkg/util/yaml/decoder.go#L347
-// because lineReader does not have a public constructor and so that we can
-// refine the return type of guessJSONStream from *io.Reader to *bufio.Reader.
-type lineReader struct {
-	reader *bufio.Reader
-}
-
-// Read returns a single line (with '\n' ended) from the underlying reader.
-// An error is returned iff there is an error with the underlying reader.
-func (r *lineReader) Read() ([]byte, error) {
-	var (
-		isPrefix bool  = true
-		err      error = nil
-		line     []byte
-		buffer   bytes.Buffer
-	)
-
-	for isPrefix && err == nil {
-		line, isPrefix, err = r.reader.ReadLine()
-		buffer.Write(line)
-	}
-	buffer.WriteByte('\n')
-	return buffer.Bytes(), err
-}
-
-// guessJSONStream scans the provided reader up to size, looking
-// for an open brace indicating this is JSON. It will return the
-// bufio.Reader it creates for the consumer.
-func guessJSONStream(r io.Reader, size int) (*bufio.Reader, []byte, bool) {
-	buffer := bufio.NewReaderSize(r, size)
-	b, _ := buffer.Peek(size)
-	return buffer, b, hasJSONPrefix(b)
-}
-
-var jsonPrefix = []byte("{")
-
-// hasJSONPrefix returns true if the provided buffer appears to start with
-// a JSON open brace.
-func hasJSONPrefix(buf []byte) bool {
-	return hasPrefix(buf, jsonPrefix)
-}
-
-// Return true if the first non-whitespace bytes in buf is
-// prefix.
-func hasPrefix(buf []byte, prefix []byte) bool {
-	trim := bytes.TrimLeftFunc(buf, unicode.IsSpace)
-	return bytes.HasPrefix(trim, prefix)
-}
@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkerd/linkerd2/pkg/inject"
+	"sigs.k8s.io/yaml"
+)
+
+// identityTransformer is a resourceTransformer whose result is always
+// identical to its original, letting tests assert that "diff"/"jsonpatch"
+// report no changes when nothing actually changed.
+type identityTransformer struct{}
+
+func (identityTransformer) transform(b []byte) ([]byte, []byte, []inject.Report, error) {
+	return b, b, nil, nil
+}
+
+func (identityTransformer) generateReport([]inject.Report, io.Writer) {}
+
+func TestProcessYAML(t *testing.T) {
+	testCases := []struct {
+		name   string
+		input  string
+		format string
+		want   string
+	}{
+		{
+			name: "diff is empty for an unchanged single resource",
+			input: `apiVersion: v1
+kind: Pod
+metadata:
+  name: a
+`,
+			format: "diff",
+			want:   "",
+		},
+		{
+			name: "jsonpatch is empty for an unchanged single resource",
+			input: `apiVersion: v1
+kind: Pod
+metadata:
+  name: a
+`,
+			format: "jsonpatch",
+			want:   "[]",
+		},
+		{
+			name: "diff is empty for an unchanged List",
+			input: `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: a
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: b
+`,
+			format: "diff",
+			want:   "",
+		},
+		{
+			name: "jsonpatch is empty for an unchanged List",
+			input: `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: a
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: b
+`,
+			format: "jsonpatch",
+			want:   "[]",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var out, report bytes.Buffer
+			errs := processYAML(strings.NewReader(tc.input), &out, &report, identityTransformer{}, tc.format, 1)
+			if len(errs) != 0 {
+				t.Fatalf("processYAML returned errors: %v", errs)
+			}
+			if got := strings.TrimSpace(out.String()); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// fieldEditTransformer removes one field and adds another, so tests can
+// exercise mergePatchToJSONPatch's "remove" and "add" op generation
+// together, not just the empty-diff case.
+type fieldEditTransformer struct{}
+
+func (fieldEditTransformer) transform(b []byte) ([]byte, []byte, []inject.Report, error) {
+	var obj map[string]interface{}
+	if err := yaml.Unmarshal(b, &obj); err != nil {
+		return nil, nil, nil, err
+	}
+
+	meta := obj["metadata"].(map[string]interface{})
+	labels := meta["labels"].(map[string]interface{})
+	delete(labels, "toRemove")
+	meta["annotations"] = map[string]interface{}{"added": "x"}
+
+	result, err := yaml.Marshal(obj)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return b, result, nil, nil
+}
+
+func (fieldEditTransformer) generateReport([]inject.Report, io.Writer) {}
+
+func TestJSONPatchAddAndRemove(t *testing.T) {
+	input := `apiVersion: v1
+kind: Pod
+metadata:
+  name: a
+  labels:
+    toRemove: gone
+`
+	var out, report bytes.Buffer
+	errs := processYAML(strings.NewReader(input), &out, &report, fieldEditTransformer{}, "jsonpatch", 1)
+	if len(errs) != 0 {
+		t.Fatalf("processYAML returned errors: %v", errs)
+	}
+
+	want := `[{"op":"add","path":"/metadata/annotations","value":{"added":"x"}},{"op":"remove","path":"/metadata/labels/toRemove"}]`
+	if got := strings.TrimSpace(out.String()); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// slowByIndexTransformer sleeps longer for earlier documents than later
+// ones, so a correct worker pool's collector has to actively reorder
+// completions rather than happen to preserve order by luck.
+type slowByIndexTransformer struct{ n int }
+
+func (s slowByIndexTransformer) transform(b []byte) ([]byte, []byte, []inject.Report, error) {
+	var obj struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	if err := yaml.Unmarshal(b, &obj); err != nil {
+		return nil, nil, nil, err
+	}
+	i, err := strconv.Atoi(strings.TrimPrefix(obj.Metadata.Name, "pod-"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	time.Sleep(time.Duration(s.n-i) * time.Millisecond)
+	return b, b, nil, nil
+}
+
+func (slowByIndexTransformer) generateReport([]inject.Report, io.Writer) {}
+
+func TestProcessYAMLParallelismPreservesOrder(t *testing.T) {
+	const n = 20
+
+	var input strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&input, "apiVersion: v1\nkind: Pod\nmetadata:\n  name: pod-%d\n---\n", i)
+	}
+
+	var out, report bytes.Buffer
+	errs := processYAML(strings.NewReader(input.String()), &out, &report, slowByIndexTransformer{n: n}, "ndjson", 8)
+	if len(errs) != 0 {
+		t.Fatalf("processYAML returned errors: %v", errs)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != n {
+		t.Fatalf("got %d documents, want %d", len(lines), n)
+	}
+	for i, line := range lines {
+		want := fmt.Sprintf("pod-%d", i)
+		if !strings.Contains(line, want) {
+			t.Errorf("document %d = %q, want it to contain %q", i, line, want)
+		}
+	}
+}
+
+func TestNDJSONFlattensListsDifferentlyFromJSON(t *testing.T) {
+	input := `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: a
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: b
+`
+	var jsonOut, ndjsonOut, report bytes.Buffer
+	if errs := processYAML(strings.NewReader(input), &jsonOut, &report, identityTransformer{}, "json", 1); len(errs) != 0 {
+		t.Fatalf("processYAML(json) returned errors: %v", errs)
+	}
+	if errs := processYAML(strings.NewReader(input), &ndjsonOut, &report, identityTransformer{}, "ndjson", 1); len(errs) != 0 {
+		t.Fatalf("processYAML(ndjson) returned errors: %v", errs)
+	}
+
+	if got := strings.Count(strings.TrimSpace(jsonOut.String()), "\n"); got != 0 {
+		t.Errorf("json output has %d newlines, want a single List document", got)
+	}
+	if got := strings.Count(strings.TrimSpace(ndjsonOut.String()), "\n"); got != 1 {
+		t.Errorf("ndjson output has %d newlines, want one per flattened List item", got)
+	}
+	if jsonOut.String() == ndjsonOut.String() {
+		t.Errorf("json and ndjson produced identical output for a List: %q", jsonOut.String())
+	}
+}
+
+func TestProcessYAMLMixedJSONAndYAMLStream(t *testing.T) {
+	input := "{\"apiVersion\":\"v1\",\"kind\":\"Pod\",\"metadata\":{\"name\":\"json-pod\"}}\n" +
+		"---\n" +
+		"apiVersion: v1\nkind: Pod\nmetadata:\n  name: yaml-pod\n"
+
+	var out, report bytes.Buffer
+	errs := processYAML(strings.NewReader(input), &out, &report, identityTransformer{}, "yaml", 1)
+	if len(errs) != 0 {
+		t.Fatalf("processYAML returned errors: %v", errs)
+	}
+
+	got := out.String()
+	if !strings.Contains(got, "json-pod") || !strings.Contains(got, "yaml-pod") {
+		t.Errorf("expected both documents in a mixed JSON/YAML stream, got:\n%s", got)
+	}
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/linkerd/linkerd2/pkg/inject"
+	"github.com/linkerd/linkerd2/pkg/k8s"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+// uninjectOptions holds the flags accepted by `linkerd uninject`.
+type uninjectOptions struct {
+	output      string
+	parallelism int
+	insecure    bool
+	digest      string
+}
+
+func newUninjectOptions() *uninjectOptions {
+	return &uninjectOptions{
+		output:      "yaml",
+		parallelism: 1,
+	}
+}
+
+func newCmdUninject() *cobra.Command {
+	options := newUninjectOptions()
+
+	cmd := &cobra.Command{
+		Use:   "uninject [flags] CONFIG-FILE",
+		Short: "Remove the Linkerd proxy from a Kubernetes config",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in, err := read(args[0], readOptions{insecure: options.insecure, digest: options.digest})
+			if err != nil {
+				return err
+			}
+
+			os.Exit(transformInput(in, os.Stderr, os.Stdout, resourceTransformerUninject{}, options.output, options.parallelism))
+			return nil
+		},
+	}
+
+	cmd.PersistentFlags().StringVarP(&options.output, "output", "o", options.output, "Output format: yaml, json, ndjson, jsonpatch, or diff")
+	cmd.PersistentFlags().IntVar(&options.parallelism, "parallelism", options.parallelism, "Number of documents to transform concurrently (<1 uses the number of CPUs)")
+	cmd.PersistentFlags().BoolVar(&options.insecure, "insecure", false, "Allow plain HTTP when CONFIG-FILE is a URL")
+	cmd.PersistentFlags().StringVar(&options.digest, "digest", "", "Verify a CONFIG-FILE URL against a sha256:<hex> digest (the manifest digest for oci://); local files and stdin are not checked")
+
+	return cmd
+}
+
+// resourceTransformerUninject implements resourceTransformer for `linkerd
+// uninject`: it removes the proxy-injection annotation from the pod template
+// the manifest describes.
+type resourceTransformerUninject struct{}
+
+func (resourceTransformerUninject) transform(bytes []byte) ([]byte, []byte, []inject.Report, error) {
+	return removeProxyInjectAnnotation(bytes)
+}
+
+func (resourceTransformerUninject) generateReport(reports []inject.Report, out io.Writer) {
+	fmt.Fprintf(out, "\nSummary: %d YAML document(s) uninjected\n", len(reports))
+}
+
+// removeProxyInjectAnnotation deletes the linkerd.io/inject annotation from
+// the Pod, or the pod template of a higher-level workload, that raw
+// describes. It returns both the re-serialized original and the updated
+// result so callers can compare them for "diff"/"jsonpatch".
+func removeProxyInjectAnnotation(raw []byte) ([]byte, []byte, []inject.Report, error) {
+	obj, err := decodeManifest(raw)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	original, err := yaml.Marshal(obj)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	delete(podTemplateAnnotations(obj), k8s.ProxyInjectAnnotation)
+
+	result, err := yaml.Marshal(obj)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return original, result, []inject.Report{{}}, nil
+}